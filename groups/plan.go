@@ -0,0 +1,211 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Change is the reconciliation work computed for a single declared group: the
+// desired state, plus a fingerprint of the live state it was computed
+// against so that Apply can detect drift.
+type Change struct {
+	EmailId string `yaml:"email-id" json:"email-id"`
+
+	// Group is the desired state to reconcile the group to.
+	Group GoogleGroup `yaml:"group" json:"group"`
+
+	// Fingerprint is a hash of the live group state (settings and roster)
+	// this Change was computed against.
+	Fingerprint string `yaml:"fingerprint" json:"fingerprint"`
+}
+
+// Plan is a structured, serializable record produced by reconciler.Plan and
+// consumed by reconciler.Apply. Each Change holds the full desired state of
+// one declared group, not the individual setting or member changes: the
+// provider works those out against the live state when Apply runs. Group
+// deletions are not recorded in the plan; Apply ends by calling the
+// provider's DeleteGroupsIfNecessary. It can be written to and read from a file via
+// the -plan-out and -plan-in flags, so a dry-run in CI can post the plan as a
+// PR comment and an approver can re-run with --confirm -plan-in to apply
+// exactly what was reviewed.
+type Plan struct {
+	Changes []Change `yaml:"changes,omitempty" json:"changes,omitempty"`
+}
+
+// Plan computes the Change needed to bring each of groups to its declared
+// state, fingerprinting the live state of each group as observed right now.
+func (r *reconciler) Plan(groups []GoogleGroup) (*Plan, error) {
+	live, err := r.provider.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	liveByEmail := make(map[string]GoogleGroup, len(live))
+	for _, g := range live {
+		liveByEmail[g.EmailId] = g
+	}
+
+	plan := &Plan{}
+	for _, g := range groups {
+		if g.EmailId == "" {
+			return nil, fmt.Errorf("group has no email-id: %#v", g)
+		}
+		plan.Changes = append(plan.Changes, Change{
+			EmailId:     g.EmailId,
+			Group:       g,
+			Fingerprint: fingerprintGroup(liveByEmail[g.EmailId]),
+		})
+	}
+	return plan, nil
+}
+
+// Apply executes plan, aborting before making any change if the live state of
+// any affected group has drifted from the state the plan was computed
+// against. Otherwise it fans the per-group work out across a bounded worker
+// pool (reconciler.concurrency) and collects errors per group so one failing
+// group doesn't abort the whole run.
+func (r *reconciler) Apply(plan *Plan) error {
+	live, err := r.provider.ListGroups()
+	if err != nil {
+		return err
+	}
+	liveByEmail := make(map[string]GoogleGroup, len(live))
+	for _, g := range live {
+		liveByEmail[g.EmailId] = g
+	}
+
+	for _, c := range plan.Changes {
+		current := fingerprintGroup(liveByEmail[c.EmailId])
+		if current != c.Fingerprint {
+			return fmt.Errorf("live state for group %q has drifted since the plan was computed (want fingerprint %s, got %s); recompute the plan and retry", c.EmailId, c.Fingerprint, current)
+		}
+	}
+
+	errs := make([]error, len(plan.Changes))
+	sem := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	for i, c := range plan.Changes {
+		i, c := i, c
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = r.applyChange(c)
+		}()
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", plan.Changes[i].EmailId, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to reconcile %d of %d group(s):\n%s", len(failures), len(plan.Changes), strings.Join(failures, "\n"))
+	}
+
+	return r.provider.DeleteGroupsIfNecessary()
+}
+
+// applyChange reconciles a single group. Rate-limiting and retrying of the
+// underlying provider calls is the provider's responsibility, since only it
+// knows how many individual API calls each of these two steps fans out to.
+func (r *reconciler) applyChange(c Change) error {
+	if err := r.provider.CreateOrUpdateGroup(c.Group); err != nil {
+		return err
+	}
+	return r.provider.SyncMembers(c.Group)
+}
+
+// fingerprintGroup hashes the parts of g's state that Apply cares about
+// staying stable between Plan and Apply: its settings and its owner/manager/
+// member roster.
+func fingerprintGroup(g GoogleGroup) string {
+	h := sha256.New()
+
+	for _, k := range sortedKeys(g.Settings) {
+		fmt.Fprintf(h, "setting:%s=%s\n", k, g.Settings[k])
+	}
+	for _, m := range sortedCopy(g.Owners) {
+		fmt.Fprintf(h, "owner:%s\n", m)
+	}
+	for _, m := range sortedCopy(g.Managers) {
+		fmt.Fprintf(h, "manager:%s\n", m)
+	}
+	for _, m := range sortedCopy(g.Members) {
+		fmt.Fprintf(h, "member:%s\n", m)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
+
+// loadOrComputePlan reads the plan from planInPath if set, otherwise computes
+// a fresh one from groups.
+func loadOrComputePlan(r *reconciler, groups []GoogleGroup, planInPath string) (*Plan, error) {
+	if planInPath == "" {
+		return r.Plan(groups)
+	}
+	return loadPlan(planInPath)
+}
+
+func loadPlan(path string) (*Plan, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file %s: %v", path, err)
+	}
+	var plan Plan
+	if err := yaml.Unmarshal(content, &plan); err != nil {
+		return nil, fmt.Errorf("error parsing plan file %s: %v", path, err)
+	}
+	return &plan, nil
+}
+
+func writePlan(plan *Plan, path string) error {
+	content, err := yaml.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("error marshaling plan: %v", err)
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("error writing plan file %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/option"
+)
+
+const (
+	googleProviderName   = "google"
+	scimProviderName     = "scim"
+	keycloakProviderName = "keycloak"
+)
+
+// Provider abstracts the identity-provider backend used to reconcile groups.
+// It lets downstream Kubernetes communities that don't run on Google
+// Workspace reuse the same groups.yaml/restrictions.yaml schema and
+// reconciliation loop against their own IdP.
+type Provider interface {
+	// CreateOrUpdateGroup ensures a group matching g exists with the
+	// configured name and description.
+	CreateOrUpdateGroup(g GoogleGroup) error
+	// SyncMembers reconciles the settings and the owners/managers/members of
+	// g against the provider's current state for the group.
+	SyncMembers(g GoogleGroup) error
+	// GetSettings returns the provider-specific settings currently applied
+	// to the group identified by emailId.
+	GetSettings(emailId string) (map[string]string, error)
+	// ListGroups returns every group known to the provider, including its
+	// settings and effective owners/managers/members.
+	ListGroups() ([]GoogleGroup, error)
+	// DeleteGroupsIfNecessary removes groups that are no longer declared, if
+	// the provider is configured to do so.
+	DeleteGroupsIfNecessary() error
+}
+
+// newProvider constructs the Provider selected by config.Provider, which
+// defaults to googleProviderName when empty. secret is the raw contents of
+// config.SecretVersion: newGoogleProvider ignores it (the caller has already
+// turned it into clientOption), while newSCIMProvider authenticates with it
+// directly, since scim/keycloak backends don't go through Google's JWT flow.
+func newProvider(ctx context.Context, config Config, clientOption option.ClientOption, secret []byte) (Provider, error) {
+	switch config.Provider {
+	case "", googleProviderName:
+		return newGoogleProvider(ctx, clientOption)
+	case scimProviderName, keycloakProviderName:
+		return newSCIMProvider(config.Provider, config.ProviderEndpoint, string(secret), config.ConfirmChanges)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+}
+
+// googleProvider implements Provider on top of the Google Admin SDK backed
+// AdminService/GroupService.
+type googleProvider struct {
+	adminService AdminService
+	groupService GroupService
+
+	// limiter is shared across all concurrent group workers and every
+	// mutating call each makes, so the combined write rate stays within the
+	// Admin SDK's write quota no matter how many Admin SDK/GroupService
+	// calls a single Provider method fans out to.
+	limiter *rate.Limiter
+
+	// mu serializes SetGroup and the calls that act on the group it sets:
+	// adminService/groupService have no per-call group argument, only a
+	// SetGroup(g) that primes their "current group" for the next call, so
+	// two goroutines reconciling different groups concurrently could
+	// otherwise interleave and apply one group's settings/members to the
+	// other.
+	mu sync.Mutex
+}
+
+func newGoogleProvider(ctx context.Context, clientOption option.ClientOption) (*googleProvider, error) {
+	as, err := NewAdminService(ctx, clientOption)
+	if err != nil {
+		return nil, err
+	}
+
+	gs, err := NewGroupService(ctx, clientOption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &googleProvider{
+		adminService: as,
+		groupService: gs,
+		limiter:      rate.NewLimiter(rate.Limit(defaultWriteQPS), defaultWriteQPS),
+	}, nil
+}
+
+// write rate-limits and retries a single mutating AdminService/GroupService
+// call, so that every write this provider makes, not just the coarse
+// Provider-method calls, counts against the write quota and is individually
+// retried on failure.
+func (p *googleProvider) write(fn func() error) error {
+	return withRetry(func() error {
+		if err := p.limiter.Wait(context.Background()); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+func (p *googleProvider) CreateOrUpdateGroup(g GoogleGroup) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.adminService.SetGroup(g)
+	p.groupService.SetGroup(g)
+	return p.write(p.adminService.CreateOrUpdateGroupIfNescessary)
+}
+
+func (p *googleProvider) SyncMembers(g GoogleGroup) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.adminService.SetGroup(g)
+	p.groupService.SetGroup(g)
+
+	if err := p.write(p.groupService.UpdateGroupSettings); err != nil {
+		return err
+	}
+	if err := p.write(func() error { return p.adminService.AddOrUpdateGroupMembers(ownerRole, g.Owners) }); err != nil {
+		return err
+	}
+	if err := p.write(func() error { return p.adminService.AddOrUpdateGroupMembers(managerRole, g.Managers) }); err != nil {
+		return err
+	}
+	if err := p.write(func() error { return p.adminService.AddOrUpdateGroupMembers(memberRole, g.Members) }); err != nil {
+		log.Println(err)
+	}
+
+	if g.Settings["ReconcileMembers"] == "true" {
+		members := append(g.Owners, g.Managers...)
+		members = append(members, g.Members...)
+		return p.write(func() error { return p.adminService.RemoveMembersFromGroup(members) })
+	}
+
+	members := append(g.Owners, g.Managers...)
+	return p.write(func() error { return p.adminService.RemoveOwnerOrManagersFromGroup(members) })
+}
+
+func (p *googleProvider) GetSettings(emailId string) (map[string]string, error) {
+	gsClient := p.groupService.GetClient()
+	g2, err := gsClient.Get(emailId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve group info for group %s: %v", emailId, err)
+	}
+
+	return map[string]string{
+		"AllowExternalMembers":     g2.AllowExternalMembers,
+		"WhoCanJoin":               g2.WhoCanJoin,
+		"WhoCanViewMembership":     g2.WhoCanViewMembership,
+		"WhoCanViewGroup":          g2.WhoCanViewGroup,
+		"WhoCanDiscoverGroup":      g2.WhoCanDiscoverGroup,
+		"WhoCanInvite":             g2.WhoCanInvite,
+		"WhoCanAdd":                g2.WhoCanAdd,
+		"WhoCanApproveMembers":     g2.WhoCanApproveMembers,
+		"WhoCanModifyMembers":      g2.WhoCanModifyMembers,
+		"WhoCanModerateMembers":    g2.WhoCanModerateMembers,
+		"MembersCanPostAsTheGroup": g2.MembersCanPostAsTheGroup,
+	}, nil
+}
+
+func (p *googleProvider) ListGroups() ([]GoogleGroup, error) {
+	asClient := p.adminService.GetClient()
+
+	gl, err := asClient.ListGroups()
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve users in domain: %v", err)
+	}
+
+	var groups []GoogleGroup
+	for _, g := range gl.Groups {
+		group := GoogleGroup{
+			EmailId:     g.Email,
+			Name:        g.Name,
+			Description: g.Description,
+		}
+
+		settings, err := p.GetSettings(g.Email)
+		if err != nil {
+			return nil, err
+		}
+		group.Settings = settings
+
+		l, err := asClient.ListMembers(g.Email)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve members in group : %v", err)
+		}
+		for _, m := range l.Members {
+			switch m.Role {
+			case ownerRole:
+				group.Owners = append(group.Owners, m.Email)
+			case managerRole:
+				group.Managers = append(group.Managers, m.Email)
+			case memberRole:
+				group.Members = append(group.Members, m.Email)
+			}
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+func (p *googleProvider) DeleteGroupsIfNecessary() error {
+	return p.write(p.adminService.DeleteGroupsIfNecessary)
+}
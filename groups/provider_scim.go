@@ -0,0 +1,271 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+
+// scimProvider implements Provider against a generic SCIM 2.0 upstream, such
+// as Keycloak, for communities that don't run on Google Workspace. It reuses
+// the same groups.yaml/restrictions.yaml schema and reconciliation loop as
+// googleProvider.
+//
+// SCIM groups have no equivalent of Google Workspace's group settings
+// (WhoCanJoin, AllowExternalMembers, ...), so GetSettings is a no-op, and the
+// protocol has no standard notion of member roles, so owners/managers/
+// members are encoded via the non-standard "type" sub-attribute of a SCIM
+// member.
+type scimProvider struct {
+	// name is the configured provider name (scim or keycloak), kept so error
+	// messages can point back at the config value that selected this backend.
+	name    string
+	baseURL string
+	token   string
+	client  *http.Client
+
+	// confirmChanges mirrors Config.ConfirmChanges: when false, do() logs and
+	// skips mutating requests instead of sending them, the same dry-run
+	// contract the google provider's --confirm=false gives the Admin SDK.
+	confirmChanges bool
+}
+
+func newSCIMProvider(name, baseURL, token string, confirmChanges bool) (*scimProvider, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("%s provider requires provider-endpoint to be set in config", name)
+	}
+	return &scimProvider{
+		name:           name,
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		token:          token,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		confirmChanges: confirmChanges,
+	}, nil
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	// Type carries the owner/manager/member role. It is not part of the SCIM
+	// core schema, but is widely supported as a free-form sub-attribute.
+	Type string `json:"type,omitempty"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members,omitempty"`
+}
+
+type scimListResponse struct {
+	Resources []scimGroupResource `json:"Resources"`
+}
+
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// CreateOrUpdateGroup creates or replaces the SCIM group whose displayName is
+// g.EmailId. Only the displayName is sent; g.Name and g.Description are not
+// stored in the IdP.
+func (p *scimProvider) CreateOrUpdateGroup(g GoogleGroup) error {
+	id, err := p.findGroupID(g.EmailId)
+	if err != nil {
+		return err
+	}
+
+	resource := scimGroupResource{
+		Schemas:     []string{scimGroupSchema},
+		DisplayName: g.EmailId,
+	}
+
+	if id == "" {
+		return withRetry(func() error { return p.do(http.MethodPost, "/Groups", resource, nil) })
+	}
+	resource.ID = id
+	return withRetry(func() error { return p.do(http.MethodPut, "/Groups/"+id, resource, nil) })
+}
+
+func (p *scimProvider) SyncMembers(g GoogleGroup) error {
+	id, err := p.findGroupID(g.EmailId)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		if !p.confirmChanges {
+			log.Printf("%s provider: confirm: false -- dry-run mode, group %q was not created, skipping member sync", p.name, g.EmailId)
+			return nil
+		}
+		return fmt.Errorf("%s provider: group %q not found; CreateOrUpdateGroup must run first", p.name, g.EmailId)
+	}
+
+	members := make([]scimMember, 0, len(g.Owners)+len(g.Managers)+len(g.Members))
+	for _, m := range g.Owners {
+		members = append(members, scimMember{Value: m, Type: strings.ToLower(ownerRole)})
+	}
+	for _, m := range g.Managers {
+		members = append(members, scimMember{Value: m, Type: strings.ToLower(managerRole)})
+	}
+	for _, m := range g.Members {
+		members = append(members, scimMember{Value: m, Type: strings.ToLower(memberRole)})
+	}
+
+	patch := scimPatchRequest{
+		Schemas: []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+		Operations: []scimPatchOp{
+			{Op: "replace", Path: "members", Value: members},
+		},
+	}
+
+	return withRetry(func() error { return p.do(http.MethodPatch, "/Groups/"+id, patch, nil) })
+}
+
+// GetSettings always returns an empty map: SCIM groups have no equivalent of
+// Google Workspace's group settings.
+func (p *scimProvider) GetSettings(emailId string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (p *scimProvider) ListGroups() ([]GoogleGroup, error) {
+	var resp scimListResponse
+	if err := withRetry(func() error { return p.do(http.MethodGet, "/Groups", nil, &resp) }); err != nil {
+		return nil, fmt.Errorf("%s provider: listing groups: %v", p.name, err)
+	}
+
+	groups := make([]GoogleGroup, 0, len(resp.Resources))
+	for _, r := range resp.Resources {
+		groups = append(groups, scimResourceToGroup(r))
+	}
+	return groups, nil
+}
+
+// DeleteGroupsIfNecessary is not yet implemented: unlike the Admin SDK, SCIM
+// has no built-in way for this tool to tell "groups no longer declared"
+// apart from "groups this tool never knew about", so groups removed from
+// groups.yaml must currently be deleted from the IdP by hand.
+func (p *scimProvider) DeleteGroupsIfNecessary() error {
+	log.Printf("%s provider: automatic group deletion is not yet implemented; remove stale groups from the IdP manually", p.name)
+	return nil
+}
+
+// findGroupID looks up the SCIM id of the group with the given displayName,
+// returning "" if no such group exists.
+func (p *scimProvider) findGroupID(displayName string) (string, error) {
+	filter := fmt.Sprintf("displayName eq %q", displayName)
+	path := "/Groups?filter=" + url.QueryEscape(filter)
+
+	var resp scimListResponse
+	if err := withRetry(func() error { return p.do(http.MethodGet, path, nil, &resp) }); err != nil {
+		return "", fmt.Errorf("%s provider: looking up group %q: %v", p.name, displayName, err)
+	}
+	if len(resp.Resources) == 0 {
+		return "", nil
+	}
+	return resp.Resources[0].ID, nil
+}
+
+func scimResourceToGroup(r scimGroupResource) GoogleGroup {
+	g := GoogleGroup{EmailId: r.DisplayName, Name: r.DisplayName}
+	for _, m := range r.Members {
+		switch strings.ToLower(m.Type) {
+		case strings.ToLower(ownerRole):
+			g.Owners = append(g.Owners, m.Value)
+		case strings.ToLower(managerRole):
+			g.Managers = append(g.Managers, m.Value)
+		default:
+			g.Members = append(g.Members, m.Value)
+		}
+	}
+	return g
+}
+
+// do issues a single SCIM 2.0 HTTP request and decodes the JSON response
+// body into out, if out is non-nil. A non-2xx response is returned as a
+// *googleapi.Error so it can be classified by withRetry the same way as
+// Google Admin SDK errors.
+//
+// Mutating requests (anything but GET) are skipped, logging instead of
+// sending them, when p.confirmChanges is false.
+func (p *scimProvider) do(method, path string, body, out interface{}) error {
+	if method != http.MethodGet && !p.confirmChanges {
+		log.Printf("%s provider: confirm: false -- dry-run mode, skipping %s %s", p.name, method, path)
+		return nil
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("%s provider: encoding request: %v", p.name, err)
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("%s provider: building request: %v", p.name, err)
+	}
+	req.Header.Set("Content-Type", "application/scim+json")
+	req.Header.Set("Accept", "application/scim+json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s provider: %s %s: %v", p.name, method, path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s provider: reading response: %v", p.name, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		return &googleapi.Error{Code: resp.StatusCode, Body: string(respBody), Header: resp.Header}
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("%s provider: decoding response: %v", p.name, err)
+		}
+	}
+	return nil
+}
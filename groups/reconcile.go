@@ -21,19 +21,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/bmatcuk/doublestar"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/groupssettings/v1"
 	"google.golang.org/api/option"
-	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
 	"gopkg.in/yaml.v3"
 
 	"k8s.io/test-infra/pkg/genyaml"
@@ -43,13 +43,21 @@ const (
 	ownerRole   = "OWNER"
 	managerRole = "MANAGER"
 	memberRole  = "MEMBER"
+
+	// defaultConcurrency is how many groups Apply reconciles in parallel
+	// when --concurrency isn't set.
+	defaultConcurrency = 8
 )
 
 type Config struct {
 	// the email id for the bot/service account
 	BotID string `yaml:"bot-id"`
 
-	// the gcloud secret containing a service account key to authenticate with
+	// SecretVersion locates the service account key to authenticate with, as
+	// a URI whose scheme selects the SecretSource: gcpsm:// (GCP Secret
+	// Manager, the default if no scheme is given), k8s:// (a Kubernetes
+	// Secret, addressed as k8s://namespace/name/key), file:// (a local
+	// path), or env:// (an environment variable).
 	SecretVersion string `yaml:"secret-version,omitempty"`
 
 	// GroupsPath is the path to the directory with
@@ -63,6 +71,15 @@ type Config struct {
 	// If not specified, it defaults to "restrictions.yaml" in the groups-path directory.
 	RestrictionsPath string `yaml:"restrictions-path,omitempty"`
 
+	// Provider selects the identity-provider backend to reconcile against:
+	// "google" (default), "scim", or "keycloak".
+	Provider string `yaml:"provider,omitempty"`
+
+	// ProviderEndpoint is the base URL of the provider's API. It is ignored
+	// by the google provider, which derives its endpoint from the Admin SDK
+	// client libraries, and required by scim/keycloak.
+	ProviderEndpoint string `yaml:"provider-endpoint,omitempty"`
+
 	// If false, don't make any mutating API calls
 	ConfirmChanges bool
 }
@@ -105,7 +122,35 @@ type Restriction struct {
 	// Compiles to AllowedGroupsRe during config load.
 	AllowedGroups []string `yaml:"allowedGroups" json:"allowedGroups"`
 
-	AllowedGroupsRe []*regexp.Regexp
+	// DeniedGroups is the list of regular expressions for email-ids of
+	// groups that cannot be defined for the Path, evaluated before
+	// AllowedGroups. A group matching both is denied.
+	//
+	// Compiles to DeniedGroupsRe during config load.
+	DeniedGroups []string `yaml:"deniedGroups,omitempty" json:"deniedGroups,omitempty"`
+
+	// AllowedOwners, if non-empty, restricts the owners of groups defined
+	// for the Path to email-ids matching at least one of these regular
+	// expressions.
+	//
+	// Compiles to AllowedOwnersRe during config load.
+	AllowedOwners []string `yaml:"allowedOwners,omitempty" json:"allowedOwners,omitempty"`
+
+	// AllowedMembers, if non-empty, restricts the managers and members of
+	// groups defined for the Path to email-ids matching at least one of
+	// these regular expressions.
+	//
+	// Compiles to AllowedMembersRe during config load.
+	AllowedMembers []string `yaml:"allowedMembers,omitempty" json:"allowedMembers,omitempty"`
+
+	// MaxMembers, if non-zero, caps the combined number of owners, managers
+	// and members a group defined for the Path may declare.
+	MaxMembers int `yaml:"maxMembers,omitempty" json:"maxMembers,omitempty"`
+
+	AllowedGroupsRe  []*regexp.Regexp
+	DeniedGroupsRe   []*regexp.Regexp
+	AllowedOwnersRe  []*regexp.Regexp
+	AllowedMembersRe []*regexp.Regexp
 }
 
 func Usage() {
@@ -133,6 +178,10 @@ func main() {
 	configFilePath := flag.String("config", defaultConfigFile, "the config file in yaml format")
 	confirmChanges := flag.Bool("confirm", false, "false by default means that we do not push anything to google groups")
 	printConfig := flag.Bool("print", false, "print the existing group information")
+	verifyGroups := flag.Bool("verify", false, "check that declared owners/managers/members are actually effective, including via nested groups, and exit non-zero on drift unless --confirm is set")
+	planOutPath := flag.String("plan-out", "", "write the computed reconciliation plan to this file instead of applying it")
+	planInPath := flag.String("plan-in", "", "apply the plan read from this file instead of computing one from groups.yaml; aborts if live group state has drifted since the plan was computed")
+	concurrency := flag.Int("concurrency", defaultConcurrency, "number of groups to reconcile in parallel")
 
 	flag.Usage = Usage
 	flag.Parse()
@@ -154,6 +203,7 @@ func main() {
 	log.Printf("config: SecretVersion:    %v", config.SecretVersion)
 	log.Printf("config: GroupsPath:       %v", config.GroupsPath)
 	log.Printf("config: RestrictionsPath: %v", config.RestrictionsPath)
+	log.Printf("config: Provider:         %v", config.Provider)
 	log.Printf("config: ConfirmChanges:   %v", config.ConfirmChanges)
 
 	err = restrictionsConfig.Load(config.RestrictionsPath)
@@ -166,25 +216,31 @@ func main() {
 		log.Fatal(err)
 	}
 
-	serviceAccountKey, err := accessSecretVersion(config.SecretVersion)
+	secret, err := accessSecretVersion(config.SecretVersion)
 	if err != nil {
 		log.Fatalf("Unable to access secret-version %s, %v", config.SecretVersion, err)
 	}
 
-	credential, err := google.JWTConfigFromJSON(serviceAccountKey, admin.AdminDirectoryUserReadonlyScope,
-		admin.AdminDirectoryGroupScope,
-		admin.AdminDirectoryGroupMemberScope,
-		groupssettings.AppsGroupsSettingsScope)
-	if err != nil {
-		log.Fatalf("Unable to authenticate using key in secret-version %s, %v", config.SecretVersion, err)
-	}
-	credential.Subject = config.BotID
-
 	ctx := context.Background()
-	client := credential.Client(ctx)
-	clientOption := option.WithHTTPClient(client)
 
-	r, err := newReconciler(ctx, clientOption)
+	// Only the google provider needs a Google-specific client: it
+	// authenticates the secret as a service account key and builds an
+	// *http.Client carrying that credential. Other providers authenticate
+	// themselves from the raw secret in newProvider.
+	var clientOption option.ClientOption
+	if config.Provider == "" || config.Provider == googleProviderName {
+		credential, err := google.JWTConfigFromJSON(secret, admin.AdminDirectoryUserReadonlyScope,
+			admin.AdminDirectoryGroupScope,
+			admin.AdminDirectoryGroupMemberScope,
+			groupssettings.AppsGroupsSettingsScope)
+		if err != nil {
+			log.Fatalf("Unable to authenticate using key in secret-version %s, %v", config.SecretVersion, err)
+		}
+		credential.Subject = config.BotID
+		clientOption = option.WithHTTPClient(credential.Client(ctx))
+	}
+
+	r, err := newReconciler(ctx, config, clientOption, secret, *concurrency)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -197,165 +253,159 @@ func main() {
 		return
 	}
 
+	if *verifyGroups {
+		log.Println(" ======================= Verify =======================")
+		err = r.verifyGroups(groupsConfig.Groups)
+		if err != nil {
+			if !config.ConfirmChanges {
+				log.Fatal(err)
+			}
+			log.Println(err)
+		}
+		return
+	}
+
 	log.Println(" ======================= Updates =======================")
-	err = r.reconcileGroups(groupsConfig.Groups)
+	plan, err := loadOrComputePlan(r, groupsConfig.Groups, *planInPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *planOutPath != "" {
+		if err := writePlan(plan, *planOutPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = r.Apply(plan)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// reconciler syncs the actual state of the world with the configuration.
-// It does so by making use of AdminService and GroupService which are mockable
-// interfaces.
+// reconciler syncs the actual state of the world with the configuration. It
+// does so by making use of a Provider, which abstracts over the concrete
+// identity-provider backend (Google Workspace, SCIM, ...).
 type reconciler struct {
-	adminService AdminService
-	groupService GroupService
+	provider Provider
+
+	// concurrency bounds how many groups Apply reconciles at once.
+	concurrency int
 }
 
-func newReconciler(ctx context.Context, clientOption option.ClientOption) (*reconciler, error) {
-	as, err := NewAdminService(ctx, clientOption)
+func newReconciler(ctx context.Context, config Config, clientOption option.ClientOption, secret []byte, concurrency int) (*reconciler, error) {
+	p, err := newProvider(ctx, config, clientOption, secret)
 	if err != nil {
 		return nil, err
 	}
 
-	gs, err := NewGroupService(ctx, clientOption)
-	if err != nil {
-		return nil, err
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
 	}
 
-	return &reconciler{adminService: as, groupService: gs}, nil
+	return &reconciler{
+		provider:    p,
+		concurrency: concurrency,
+	}, nil
 }
 
-func (r *reconciler) reconcileGroups(groups []GoogleGroup) error {
-	for _, g := range groups {
-		if g.EmailId == "" {
-			return fmt.Errorf("group has no email-id: %#v", g)
-		}
-
-		// update the group that is currently being considered.
-		r.adminService.SetGroup(g)
-		r.groupService.SetGroup(g)
-
-		err := r.adminService.CreateOrUpdateGroupIfNescessary()
-		if err != nil {
-			return err
-		}
-		err = r.groupService.UpdateGroupSettings()
-		if err != nil {
-			return err
-		}
-		err = r.adminService.AddOrUpdateGroupMembers(ownerRole, g.Owners)
-		if err != nil {
-			return err
-		}
-		err = r.adminService.AddOrUpdateGroupMembers(managerRole, g.Managers)
-		if err != nil {
-			return err
-		}
-		err = r.adminService.AddOrUpdateGroupMembers(memberRole, g.Members)
-		if err != nil {
-			log.Println(err)
-		}
-
-		if g.Settings["ReconcileMembers"] == "true" {
-			members := append(g.Owners, g.Managers...)
-			members = append(members, g.Members...)
-			err = r.adminService.RemoveMembersFromGroup(members)
-			if err != nil {
-				return err
-			}
-		} else {
-			members := append(g.Owners, g.Managers...)
-			err = r.adminService.RemoveOwnerOrManagersFromGroup(members)
-			if err != nil {
-				return err
-			}
-		}
-	}
-	err := r.adminService.DeleteGroupsIfNecessary()
+func (r *reconciler) printGroupMembersAndSettings() error {
+	groups, err := r.provider.ListGroups()
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	if len(groups) == 0 {
+		log.Println("No groups found.")
+		return nil
+	}
 
-func (r *reconciler) printGroupMembersAndSettings() error {
-	asClient := r.adminService.GetClient()
-	gsClient := r.groupService.GetClient()
+	groupsConfig := GroupsConfig{Groups: groups}
 
-	g, err := asClient.ListGroups()
+	cm := genyaml.NewCommentMap("reconcile.go")
+	yamlSnippet, err := cm.GenYaml(groupsConfig)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve users in domain: %v", err)
+		return fmt.Errorf("unable to generate yaml for groups : %v", err)
 	}
 
-	if len(g.Groups) == 0 {
-		log.Println("No groups found.")
-		return nil
-	}
+	fmt.Println(yamlSnippet)
+	return nil
+}
 
-	var groupsConfig GroupsConfig
-	for _, g := range g.Groups {
-		group := GoogleGroup{
-			EmailId:     g.Email,
-			Name:        g.Name,
-			Description: g.Description,
-		}
-		g2, err := gsClient.Get(g.Email)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve group info for group %s: %v", g.Email, err)
-		}
-		group.Settings = make(map[string]string)
-		group.Settings["AllowExternalMembers"] = g2.AllowExternalMembers
-		group.Settings["WhoCanJoin"] = g2.WhoCanJoin
-		group.Settings["WhoCanViewMembership"] = g2.WhoCanViewMembership
-		group.Settings["WhoCanViewGroup"] = g2.WhoCanViewGroup
-		group.Settings["WhoCanDiscoverGroup"] = g2.WhoCanDiscoverGroup
-		group.Settings["WhoCanInvite"] = g2.WhoCanInvite
-		group.Settings["WhoCanAdd"] = g2.WhoCanAdd
-		group.Settings["WhoCanApproveMembers"] = g2.WhoCanApproveMembers
-		group.Settings["WhoCanModifyMembers"] = g2.WhoCanModifyMembers
-		group.Settings["WhoCanModerateMembers"] = g2.WhoCanModerateMembers
-		group.Settings["MembersCanPostAsTheGroup"] = g2.MembersCanPostAsTheGroup
-
-		l, err := asClient.ListMembers(g.Email)
-		if err != nil {
-			return fmt.Errorf("unable to retrieve members in group : %v", err)
+// verifyGroups checks that the owners/managers/members declared in groups.yaml
+// are actually resolvable and effective members of their group, including
+// transitively via nested groups. It logs one line for each declared owner/
+// manager/member that is not an effective member of its group, or that could
+// not be checked, and returns an error giving the number of such lines, so
+// that it can be wired into CI as an audit step via --verify. Effective
+// members that groups.yaml does not declare are not reported.
+func (r *reconciler) verifyGroups(groups []GoogleGroup) error {
+	var driftErrs []string
+	for _, g := range groups {
+		declared := map[string][]string{
+			ownerRole:   g.Owners,
+			managerRole: g.Managers,
+			memberRole:  g.Members,
 		}
 
-		if len(l.Members) == 0 {
-			log.Println("No members found in group.")
-		} else {
-			for _, m := range l.Members {
-				if m.Role == ownerRole {
-					group.Owners = append(group.Owners, m.Email)
-				}
-			}
-			for _, m := range l.Members {
-				if m.Role == managerRole {
-					group.Managers = append(group.Managers, m.Email)
+		for role, members := range declared {
+			for _, m := range members {
+				effective, err := r.isEffectiveMember(g.EmailId, m)
+				if err != nil {
+					driftErrs = append(driftErrs, fmt.Sprintf("%s: unable to verify %s %s: %v", g.EmailId, role, m, err))
+					continue
 				}
-			}
-			for _, m := range l.Members {
-				if m.Role == memberRole {
-					group.Members = append(group.Members, m.Email)
+				if !effective {
+					driftErrs = append(driftErrs, fmt.Sprintf("%s: declared %s %s is not an effective member", g.EmailId, role, m))
 				}
 			}
 		}
-
-		groupsConfig.Groups = append(groupsConfig.Groups, group)
 	}
 
-	cm := genyaml.NewCommentMap("reconcile.go")
-	yamlSnippet, err := cm.GenYaml(groupsConfig)
-	if err != nil {
-		return fmt.Errorf("unable to generate yaml for groups : %v", err)
+	for _, e := range driftErrs {
+		log.Println(e)
 	}
 
-	fmt.Println(yamlSnippet)
+	if len(driftErrs) > 0 {
+		return fmt.Errorf("found %d declared-vs-effective drift(s)", len(driftErrs))
+	}
 	return nil
 }
 
+// isEffectiveMember reports whether member is an effective (possibly
+// transitive, nested-group) member of group. It first asks members.hasMember,
+// which understands nested group membership. members.hasMember returns HTTP
+// 400 when member's email is outside the workspace domain, in which case we
+// fall back to members.get to confirm direct membership instead.
+//
+// This nested-group check is specific to the Google Admin SDK, so --verify
+// is only supported when running against the google provider.
+func (r *reconciler) isEffectiveMember(group, member string) (bool, error) {
+	gp, ok := r.provider.(*googleProvider)
+	if !ok {
+		return false, fmt.Errorf("--verify is only supported with the %s provider", googleProviderName)
+	}
+	asClient := gp.adminService.GetClient()
+
+	has, err := asClient.HasMember(group, member)
+	if err == nil {
+		return has.IsMember, nil
+	}
+
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusBadRequest {
+		if _, getErr := asClient.GetMember(group, member); getErr != nil {
+			if apiErr, ok := getErr.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+				return false, nil
+			}
+			return false, getErr
+		}
+		return true, nil
+	}
+
+	return false, err
+}
+
 func (c *Config) Load(configFilePath string, confirmChanges bool) error {
 	log.Printf("reading config file: %s", configFilePath)
 	content, err := ioutil.ReadFile(configFilePath)
@@ -380,6 +430,10 @@ func (c *Config) Load(configFilePath string, confirmChanges bool) error {
 		c.RestrictionsPath = filepath.Join(c.GroupsPath, defaultRestrictionsFile)
 	}
 
+	if c.Provider == "" {
+		c.Provider = googleProviderName
+	}
+
 	c.ConfirmChanges = confirmChanges
 	return err
 }
@@ -398,13 +452,18 @@ func (rc *RestrictionsConfig) Load(path string) error {
 
 	ret := make([]Restriction, 0, len(rc.Restrictions))
 	for _, r := range rc.Restrictions {
-		r.AllowedGroupsRe = make([]*regexp.Regexp, 0, len(r.AllowedGroups))
-		for _, g := range r.AllowedGroups {
-			re, err := regexp.Compile(g)
-			if err != nil {
-				return fmt.Errorf("error parsing group pattern %q for path %q: %v", g, r.Path, err)
-			}
-			r.AllowedGroupsRe = append(r.AllowedGroupsRe, re)
+		var compileErr error
+		if r.AllowedGroupsRe, compileErr = compileRegexList(r.AllowedGroups, "allowedGroups", r.Path); compileErr != nil {
+			return compileErr
+		}
+		if r.DeniedGroupsRe, compileErr = compileRegexList(r.DeniedGroups, "deniedGroups", r.Path); compileErr != nil {
+			return compileErr
+		}
+		if r.AllowedOwnersRe, compileErr = compileRegexList(r.AllowedOwners, "allowedOwners", r.Path); compileErr != nil {
+			return compileErr
+		}
+		if r.AllowedMembersRe, compileErr = compileRegexList(r.AllowedMembers, "allowedMembers", r.Path); compileErr != nil {
+			return compileErr
 		}
 		ret = append(ret, r)
 	}
@@ -412,10 +471,24 @@ func (rc *RestrictionsConfig) Load(path string) error {
 	return err
 }
 
+// compileRegexList compiles each pattern in patterns, returning a descriptive
+// error naming the offending field and path on failure.
+func compileRegexList(patterns []string, field, path string) ([]*regexp.Regexp, error) {
+	re := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		compiled, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s pattern %q for path %q: %v", field, p, path, err)
+		}
+		re = append(re, compiled)
+	}
+	return re, nil
+}
+
 // readGroupsConfig starts at the rootDir and recursively walksthrough
 // all directories and files. It reads the GroupsConfig from all groups.yaml
-// files and verifies that the groups in GroupsConfig satisfy the
-// restrictions in restrictionsConfig.
+// files and verifies that the groups in GroupsConfig, and their owner/manager/
+// member rosters, satisfy the restrictions in restrictionsConfig.
 // Finally, it adds all the groups in each GroupsConfig to config.Groups.
 func (gc *GroupsConfig) Load(rootDir string, restrictions *RestrictionsConfig) error {
 	log.Printf("reading groups.yaml files recursively at %s", rootDir)
@@ -475,42 +548,56 @@ func mergeGroups(a []GoogleGroup, b []GoogleGroup, r Restriction) ([]GoogleGroup
 		if v.EmailId == "" {
 			return nil, fmt.Errorf("groups must have email-id")
 		}
+		if matchesRegexList(v.EmailId, r.DeniedGroupsRe) {
+			return nil, fmt.Errorf("group %q is denied in %q", v.EmailId, r.Path)
+		}
 		if !matchesRegexList(v.EmailId, r.AllowedGroupsRe) {
 			return nil, fmt.Errorf("cannot define group %q in %q", v.EmailId, r.Path)
 		}
 		if _, ok := emails[v.EmailId]; ok {
 			return nil, fmt.Errorf("cannot overwrite group definitions (duplicate group name %s)", v.EmailId)
 		}
+		if err := checkRosterRestrictions(v, r); err != nil {
+			return nil, err
+		}
 	}
 	return append(a, b...), nil
 }
 
-func matchesRegexList(s string, list []*regexp.Regexp) bool {
-	for _, r := range list {
-		if r.MatchString(s) {
-			return true
+// checkRosterRestrictions validates the owners/managers/members roster of g
+// against the owner/member email patterns and the size cap configured for r.
+func checkRosterRestrictions(g GoogleGroup, r Restriction) error {
+	if len(r.AllowedOwnersRe) > 0 {
+		for _, o := range g.Owners {
+			if !matchesRegexList(o, r.AllowedOwnersRe) {
+				return fmt.Errorf("owner %q of group %q is not allowed in %q", o, g.EmailId, r.Path)
+			}
 		}
 	}
-	return false
-}
 
-// accessSecretVersion accesses the payload for the given secret version if one exists
-// secretVersion is of the form projects/{project}/secrets/{secret}/versions/{version}
-func accessSecretVersion(secretVersion string) ([]byte, error) {
-	ctx := context.Background()
-	client, err := secretmanager.NewClient(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create secretmanager client: %v", err)
+	if len(r.AllowedMembersRe) > 0 {
+		for _, m := range append(append([]string{}, g.Managers...), g.Members...) {
+			if !matchesRegexList(m, r.AllowedMembersRe) {
+				return fmt.Errorf("member %q of group %q is not allowed in %q", m, g.EmailId, r.Path)
+			}
+		}
 	}
 
-	req := &secretmanagerpb.AccessSecretVersionRequest{
-		Name: secretVersion,
+	if r.MaxMembers > 0 {
+		total := len(g.Owners) + len(g.Managers) + len(g.Members)
+		if total > r.MaxMembers {
+			return fmt.Errorf("group %q has %d members, exceeding the cap of %d for %q", g.EmailId, total, r.MaxMembers, r.Path)
+		}
 	}
 
-	result, err := client.AccessSecretVersion(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to access secret version: %v", err)
-	}
+	return nil
+}
 
-	return result.Payload.Data, nil
+func matchesRegexList(s string, list []*regexp.Regexp) bool {
+	for _, r := range list {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
 }
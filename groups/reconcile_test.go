@@ -0,0 +1,177 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// mustCompileAll is a test helper standing in for compileRegexList, since the
+// Restriction literals below are built directly rather than parsed from yaml.
+func mustCompileAll(t *testing.T, patterns ...string) []*regexp.Regexp {
+	t.Helper()
+	re := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re = append(re, regexp.MustCompile(p))
+	}
+	return re
+}
+
+func TestCheckRosterRestrictions(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   GoogleGroup
+		r       Restriction
+		wantErr bool
+	}{
+		{
+			name:  "no restrictions configured",
+			group: GoogleGroup{EmailId: "a@example.com", Owners: []string{"anyone@elsewhere.com"}},
+			r:     Restriction{Path: "team-a"},
+		},
+		{
+			name:  "owner matches allowed pattern",
+			group: GoogleGroup{EmailId: "a@example.com", Owners: []string{"owner@example.com"}},
+			r:     Restriction{Path: "team-a", AllowedOwnersRe: mustCompileAll(t, "^.+@example\\.com$")},
+		},
+		{
+			name:    "owner violates allowed pattern",
+			group:   GoogleGroup{EmailId: "a@example.com", Owners: []string{"owner@other.com"}},
+			r:       Restriction{Path: "team-a", AllowedOwnersRe: mustCompileAll(t, "^.+@example\\.com$")},
+			wantErr: true,
+		},
+		{
+			name:  "manager and member match allowed pattern",
+			group: GoogleGroup{EmailId: "a@example.com", Managers: []string{"m@example.com"}, Members: []string{"u@example.com"}},
+			r:     Restriction{Path: "team-a", AllowedMembersRe: mustCompileAll(t, "^.+@example\\.com$")},
+		},
+		{
+			name:    "member violates allowed pattern",
+			group:   GoogleGroup{EmailId: "a@example.com", Members: []string{"u@other.com"}},
+			r:       Restriction{Path: "team-a", AllowedMembersRe: mustCompileAll(t, "^.+@example\\.com$")},
+			wantErr: true,
+		},
+		{
+			name:    "manager violates allowed pattern",
+			group:   GoogleGroup{EmailId: "a@example.com", Managers: []string{"m@other.com"}},
+			r:       Restriction{Path: "team-a", AllowedMembersRe: mustCompileAll(t, "^.+@example\\.com$")},
+			wantErr: true,
+		},
+		{
+			name:  "roster at MaxMembers boundary is allowed",
+			group: GoogleGroup{EmailId: "a@example.com", Owners: []string{"o1"}, Managers: []string{"m1"}, Members: []string{"u1"}},
+			r:     Restriction{Path: "team-a", MaxMembers: 3},
+		},
+		{
+			name:    "roster over MaxMembers is denied",
+			group:   GoogleGroup{EmailId: "a@example.com", Owners: []string{"o1"}, Managers: []string{"m1"}, Members: []string{"u1", "u2"}},
+			r:       Restriction{Path: "team-a", MaxMembers: 3},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRosterRestrictions(tt.group, tt.r)
+			if tt.wantErr && err == nil {
+				t.Fatalf("checkRosterRestrictions() = nil error, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("checkRosterRestrictions() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeGroups(t *testing.T) {
+	allowAll := Restriction{Path: "*", AllowedGroupsRe: mustCompileAll(t, "")}
+
+	tests := []struct {
+		name    string
+		a       []GoogleGroup
+		b       []GoogleGroup
+		r       Restriction
+		wantErr bool
+		wantLen int
+	}{
+		{
+			name:    "merges disjoint groups",
+			a:       []GoogleGroup{{EmailId: "a@example.com"}},
+			b:       []GoogleGroup{{EmailId: "b@example.com"}},
+			r:       allowAll,
+			wantLen: 2,
+		},
+		{
+			name:    "group with no email-id is rejected",
+			b:       []GoogleGroup{{EmailId: ""}},
+			r:       allowAll,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate email-id is rejected",
+			a:       []GoogleGroup{{EmailId: "a@example.com"}},
+			b:       []GoogleGroup{{EmailId: "a@example.com"}},
+			r:       allowAll,
+			wantErr: true,
+		},
+		{
+			name: "group outside AllowedGroups is rejected",
+			b:    []GoogleGroup{{EmailId: "a@example.com"}},
+			r:    Restriction{Path: "team-a", AllowedGroupsRe: mustCompileAll(t, "^b@")},
+			wantErr: true,
+		},
+		{
+			name: "group matching both AllowedGroups and DeniedGroups is denied",
+			b:    []GoogleGroup{{EmailId: "a@example.com"}},
+			r: Restriction{
+				Path:            "team-a",
+				AllowedGroupsRe: mustCompileAll(t, "^a@"),
+				DeniedGroupsRe:  mustCompileAll(t, "^a@"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "roster restriction violation is propagated",
+			b:    []GoogleGroup{{EmailId: "a@example.com", Owners: []string{"o@other.com"}}},
+			r: Restriction{
+				Path:            "team-a",
+				AllowedGroupsRe: mustCompileAll(t, "^a@"),
+				AllowedOwnersRe: mustCompileAll(t, "^.+@example\\.com$"),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeGroups(tt.a, tt.b, tt.r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("mergeGroups() = nil error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeGroups() returned unexpected error: %v", err)
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("mergeGroups() returned %d groups, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+}
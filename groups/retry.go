@@ -0,0 +1,99 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// maxRetryAttempts bounds how many times withRetry will call a failing
+	// function, the first call included, before giving up.
+	maxRetryAttempts = 5
+
+	// defaultWriteQPS approximates the Admin SDK's write quota and is shared
+	// across all concurrent group workers via googleProvider.limiter.
+	defaultWriteQPS = 10
+)
+
+// withRetry calls fn, retrying on HTTP 403/429/5xx responses from the Admin
+// SDK. It honors a Retry-After header when present, and otherwise backs off
+// exponentially with jitter, giving up after maxRetryAttempts.
+func withRetry(fn func() error) error {
+	var lastErr error
+	for attempt := 0; attempt < maxRetryAttempts; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		delay, retryable := retryDelay(err, attempt)
+		if !retryable {
+			return err
+		}
+		if attempt == maxRetryAttempts-1 {
+			break
+		}
+		log.Printf("retrying after error (attempt %d/%d, waiting %s): %v", attempt+1, maxRetryAttempts, delay, err)
+		time.Sleep(delay)
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", maxRetryAttempts, lastErr)
+}
+
+// retryDelay reports how long to wait before retrying err, and whether err is
+// retryable at all. Only HTTP 403, 429, and 5xx googleapi.Errors are retried;
+// a 403 is retried whatever its reason.
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return 0, false
+	}
+	if apiErr.Code != http.StatusForbidden && apiErr.Code != http.StatusTooManyRequests && apiErr.Code < 500 {
+		return 0, false
+	}
+
+	if d, ok := retryAfter(apiErr); ok {
+		return d, true
+	}
+
+	backoff := time.Duration(1<<uint(attempt)) * time.Second
+	jitter := time.Duration(rand.Int63n(int64(backoff/2) + 1))
+	return backoff + jitter, true
+}
+
+// retryAfter parses the Retry-After header of a googleapi.Error, if present.
+// Only a delay in whole seconds is understood; an HTTP-date value is treated
+// as if the header were absent.
+func retryAfter(apiErr *googleapi.Error) (time.Duration, bool) {
+	v := apiErr.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
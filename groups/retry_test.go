@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		attempt      int
+		wantRetry    bool
+		wantExactDur time.Duration // only checked when non-zero
+	}{
+		{
+			name:      "non-googleapi error is not retryable",
+			err:       errors.New("boom"),
+			wantRetry: false,
+		},
+		{
+			name:      "400 is not retryable",
+			err:       &googleapi.Error{Code: http.StatusBadRequest},
+			wantRetry: false,
+		},
+		{
+			name:      "403 is retryable",
+			err:       &googleapi.Error{Code: http.StatusForbidden},
+			wantRetry: true,
+		},
+		{
+			name:      "429 is retryable",
+			err:       &googleapi.Error{Code: http.StatusTooManyRequests},
+			wantRetry: true,
+		},
+		{
+			name:      "499 is not retryable",
+			err:       &googleapi.Error{Code: 499},
+			wantRetry: false,
+		},
+		{
+			name:      "500 is retryable",
+			err:       &googleapi.Error{Code: http.StatusInternalServerError},
+			wantRetry: true,
+		},
+		{
+			name: "Retry-After header wins over backoff",
+			err: &googleapi.Error{
+				Code:   http.StatusTooManyRequests,
+				Header: http.Header{"Retry-After": []string{"7"}},
+			},
+			wantRetry:    true,
+			wantExactDur: 7 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retryable := retryDelay(tt.err, tt.attempt)
+			if retryable != tt.wantRetry {
+				t.Fatalf("retryDelay() retryable = %v, want %v", retryable, tt.wantRetry)
+			}
+			if !retryable {
+				return
+			}
+			if tt.wantExactDur != 0 && delay != tt.wantExactDur {
+				t.Errorf("retryDelay() = %s, want %s", delay, tt.wantExactDur)
+			}
+		})
+	}
+}
+
+func TestRetryDelayBackoffGrows(t *testing.T) {
+	// Without a Retry-After header, the minimum possible delay (zero jitter)
+	// should still grow with the attempt number.
+	var mins []time.Duration
+	for attempt := 0; attempt < 4; attempt++ {
+		min := time.Duration(1<<uint(attempt)) * time.Second
+		mins = append(mins, min)
+
+		delay, retryable := retryDelay(&googleapi.Error{Code: http.StatusTooManyRequests}, attempt)
+		if !retryable {
+			t.Fatalf("attempt %d: retryDelay() retryable = false, want true", attempt)
+		}
+		if delay < min {
+			t.Errorf("attempt %d: retryDelay() = %s, want >= %s", attempt, delay, min)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantOk  bool
+		wantDur time.Duration
+	}{
+		{
+			name:   "no header",
+			header: http.Header{},
+			wantOk: false,
+		},
+		{
+			name:   "malformed header",
+			header: http.Header{"Retry-After": []string{"not-a-number"}},
+			wantOk: false,
+		},
+		{
+			name:    "valid header",
+			header:  http.Header{"Retry-After": []string{"30"}},
+			wantOk:  true,
+			wantDur: 30 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := retryAfter(&googleapi.Error{Header: tt.header})
+			if ok != tt.wantOk {
+				t.Fatalf("retryAfter() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && d != tt.wantDur {
+				t.Errorf("retryAfter() = %s, want %s", d, tt.wantDur)
+			}
+		})
+	}
+}
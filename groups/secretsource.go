@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"golang.org/x/net/context"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	gcpsmScheme = "gcpsm"
+	k8sScheme   = "k8s"
+	fileScheme  = "file"
+	envScheme   = "env"
+)
+
+// SecretSource resolves the service-account key used to authenticate with the
+// IdP, from a backend selected by the URI scheme of Config.SecretVersion.
+// This lets the tool run without GCP Secret Manager access, e.g. as a
+// CronJob/Deployment inside a cluster reading from a Kubernetes Secret.
+type SecretSource interface {
+	// Access returns the raw secret contents addressed by ref, which is the
+	// part of the secret-version URI following "scheme://".
+	Access(ref string) ([]byte, error)
+}
+
+// accessSecretVersion resolves secretVersion to a SecretSource by URI scheme
+// and returns the secret payload it addresses. For backwards compatibility, a
+// secretVersion with no scheme (of the form "projects/.../versions/...") is
+// treated as gcpsm://.
+func accessSecretVersion(secretVersion string) ([]byte, error) {
+	src, ref, err := secretSourceFor(secretVersion)
+	if err != nil {
+		return nil, err
+	}
+	return src.Access(ref)
+}
+
+func secretSourceFor(secretVersion string) (SecretSource, string, error) {
+	scheme, ref, ok := splitScheme(secretVersion)
+	if !ok {
+		// No scheme: assume a bare GCP Secret Manager resource name, as
+		// accepted historically.
+		return gcpSecretManagerSource{}, secretVersion, nil
+	}
+
+	switch scheme {
+	case gcpsmScheme:
+		return gcpSecretManagerSource{}, ref, nil
+	case k8sScheme:
+		return k8sSecretSource{}, ref, nil
+	case fileScheme:
+		return fileSecretSource{}, ref, nil
+	case envScheme:
+		return envSecretSource{}, ref, nil
+	default:
+		return nil, "", fmt.Errorf("unknown secret-version scheme %q in %q", scheme, secretVersion)
+	}
+}
+
+// splitScheme splits a "scheme://ref" URI into its scheme and ref. ok is
+// false when secretVersion has no "://" separator.
+func splitScheme(secretVersion string) (scheme, ref string, ok bool) {
+	parts := strings.SplitN(secretVersion, "://", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// gcpSecretManagerSource accesses a secret version payload from GCP Secret
+// Manager. ref is of the form projects/{project}/secrets/{secret}/versions/{version}.
+type gcpSecretManagerSource struct{}
+
+func (gcpSecretManagerSource) Access(ref string) ([]byte, error) {
+	ctx := context.Background()
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secretmanager client: %v", err)
+	}
+
+	req := &secretmanagerpb.AccessSecretVersionRequest{
+		Name: ref,
+	}
+
+	result, err := client.AccessSecretVersion(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access secret version: %v", err)
+	}
+
+	return result.Payload.Data, nil
+}
+
+// k8sSecretSource reads a key out of a Kubernetes Secret via the in-cluster
+// API server config, so the tool can run as a CronJob/Deployment without
+// needing GCP Secret Manager access. ref is of the form namespace/name/key.
+type k8sSecretSource struct{}
+
+func (k8sSecretSource) Access(ref string) ([]byte, error) {
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("k8s secret-version must be of the form k8s://namespace/name/key, got %q", ref)
+	}
+	namespace, name, key := parts[0], parts[1], parts[2]
+
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster config: %v", err)
+	}
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %v", namespace, name, err)
+	}
+
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %q", namespace, name, key)
+	}
+	return data, nil
+}
+
+// fileSecretSource reads the secret payload from a local file. ref is the
+// absolute path to the file.
+type fileSecretSource struct{}
+
+func (fileSecretSource) Access(ref string) ([]byte, error) {
+	return ioutil.ReadFile(ref)
+}
+
+// envSecretSource reads the secret payload from an environment variable. ref
+// is the variable name.
+type envSecretSource struct{}
+
+func (envSecretSource) Access(ref string) ([]byte, error) {
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %q is not set", ref)
+	}
+	return []byte(v), nil
+}
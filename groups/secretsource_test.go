@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitScheme(t *testing.T) {
+	tests := []struct {
+		name          string
+		secretVersion string
+		wantScheme    string
+		wantRef       string
+		wantOk        bool
+	}{
+		{
+			name:          "file scheme",
+			secretVersion: "file:///etc/secret",
+			wantScheme:    "file",
+			wantRef:       "/etc/secret",
+			wantOk:        true,
+		},
+		{
+			name:          "env scheme",
+			secretVersion: "env://SECRET_VAR",
+			wantScheme:    "env",
+			wantRef:       "SECRET_VAR",
+			wantOk:        true,
+		},
+		{
+			name:          "no scheme",
+			secretVersion: "projects/foo/secrets/bar/versions/latest",
+			wantOk:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, ref, ok := splitScheme(tt.secretVersion)
+			if ok != tt.wantOk {
+				t.Fatalf("splitScheme(%q) ok = %v, want %v", tt.secretVersion, ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if scheme != tt.wantScheme || ref != tt.wantRef {
+				t.Errorf("splitScheme(%q) = (%q, %q), want (%q, %q)", tt.secretVersion, scheme, ref, tt.wantScheme, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestSecretSourceFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		secretVersion string
+		wantRef       string
+		wantType      SecretSource
+		wantErr       bool
+	}{
+		{
+			name:          "gcpsm scheme",
+			secretVersion: "gcpsm://projects/foo/secrets/bar/versions/latest",
+			wantRef:       "projects/foo/secrets/bar/versions/latest",
+			wantType:      gcpSecretManagerSource{},
+		},
+		{
+			name:          "no scheme defaults to gcpsm for backwards compatibility",
+			secretVersion: "projects/foo/secrets/bar/versions/latest",
+			wantRef:       "projects/foo/secrets/bar/versions/latest",
+			wantType:      gcpSecretManagerSource{},
+		},
+		{
+			name:          "k8s scheme",
+			secretVersion: "k8s://namespace/name/key",
+			wantRef:       "namespace/name/key",
+			wantType:      k8sSecretSource{},
+		},
+		{
+			name:          "file scheme",
+			secretVersion: "file:///etc/secret",
+			wantRef:       "/etc/secret",
+			wantType:      fileSecretSource{},
+		},
+		{
+			name:          "env scheme",
+			secretVersion: "env://SECRET_VAR",
+			wantRef:       "SECRET_VAR",
+			wantType:      envSecretSource{},
+		},
+		{
+			name:          "unknown scheme",
+			secretVersion: "ssm://foo",
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, ref, err := secretSourceFor(tt.secretVersion)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("secretSourceFor(%q) = nil error, want error", tt.secretVersion)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("secretSourceFor(%q) returned unexpected error: %v", tt.secretVersion, err)
+			}
+			if ref != tt.wantRef {
+				t.Errorf("secretSourceFor(%q) ref = %q, want %q", tt.secretVersion, ref, tt.wantRef)
+			}
+			if src != tt.wantType {
+				t.Errorf("secretSourceFor(%q) source = %#v, want %#v", tt.secretVersion, src, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestFileSecretSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte("sekrit"), 0600); err != nil {
+		t.Fatalf("writing test file: %v", err)
+	}
+
+	got, err := (fileSecretSource{}).Access(path)
+	if err != nil {
+		t.Fatalf("Access(%q) returned error: %v", path, err)
+	}
+	if string(got) != "sekrit" {
+		t.Errorf("Access(%q) = %q, want %q", path, got, "sekrit")
+	}
+
+	if _, err := (fileSecretSource{}).Access(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Access of a missing file returned no error, want one")
+	}
+}
+
+func TestEnvSecretSource(t *testing.T) {
+	t.Setenv("GROUPS_TEST_SECRET", "sekrit")
+
+	got, err := (envSecretSource{}).Access("GROUPS_TEST_SECRET")
+	if err != nil {
+		t.Fatalf("Access returned error: %v", err)
+	}
+	if string(got) != "sekrit" {
+		t.Errorf("Access = %q, want %q", got, "sekrit")
+	}
+
+	if _, err := (envSecretSource{}).Access("GROUPS_TEST_SECRET_UNSET"); err == nil {
+		t.Error("Access of an unset environment variable returned no error, want one")
+	}
+	if _, ok := os.LookupEnv("GROUPS_TEST_SECRET_UNSET"); ok {
+		t.Fatal("test setup error: GROUPS_TEST_SECRET_UNSET is set")
+	}
+}